@@ -0,0 +1,46 @@
+package qrp
+
+import (
+	"context"
+	"net"
+)
+
+// One query to issue as part of a CallBatch, pairing the untyped args/reply that Call
+// normally takes individually.
+type BatchRequest struct {
+	Procedure string
+	Args      interface{}
+	Reply     interface{}
+}
+
+// The per-request outcome of a CallBatch, in the same order as the requests passed in.
+type BatchResponse struct {
+	Err error
+}
+
+// CallBatch issues requests to addr, returning one BatchResponse per request in the same
+// order as requests. On Linux, datagrams that fit in a single packet are coalesced into as
+// few sendmmsg syscalls as possible (see batch_linux.go); requests that need fragmentation,
+// or any platform other than Linux, fall back to running them through Call one at a time.
+func (node *Node) CallBatch(ctx context.Context, addr net.Addr, requests []BatchRequest) []BatchResponse {
+	return node.callBatch(ctx, addr, requests)
+}
+
+// ListenAndServeBatch is ListenAndServe's vectorized-I/O counterpart: on Linux it reads up
+// to batchSize datagrams per syscall with ipv4.PacketConn.ReadBatch (recvmmsg) instead of
+// one ReadFrom per datagram; on other platforms it behaves exactly like ListenAndServe.
+func (node *Node) ListenAndServeBatch() error {
+	return node.listenAndServeBatch()
+}
+
+// newBuffer returns a connectionMTU-sized buffer from node.bufferPool instead of
+// allocating one, so ListenAndServe's read loop doesn't make() a new buffer per packet.
+func (node *Node) newBuffer() []byte {
+	buffer := node.bufferPool.Get().([]byte)
+	return buffer[:node.connectionMTU]
+}
+
+// putBuffer returns a buffer obtained from newBuffer to the pool
+func (node *Node) putBuffer(buffer []byte) {
+	node.bufferPool.Put(buffer)
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package qrp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Number of datagrams read or written per recvmmsg/sendmmsg syscall.
+const batchSize = 32
+
+// One query still waiting on its reply after callBatch's WriteBatch call
+type batchInFlight struct {
+	index        int
+	procedure    string
+	thisCall     call
+	responseChan responseChannel
+	reply        interface{}
+}
+
+// callBatch prepares a datagram for each request and flushes the ones that fit in a single
+// packet together via WriteBatch (sendmmsg), then waits for each reply through the normal
+// Node.pending machinery. Requests that need fragmentation fall back to Call, since a
+// fragmented message's pieces have to be sent in order on their own.
+func (node *Node) callBatch(ctx context.Context, addr net.Addr, requests []BatchRequest) []BatchResponse {
+	responses := make([]BatchResponse, len(requests))
+
+	// The version handshake is its own round trip; get it out of the way before batching
+	// the application queries.
+	if err := node.Version(ctx, addr); err != nil {
+		for i := range requests {
+			responses[i].Err = err
+		}
+		return responses
+	}
+	codec := node.codecFor(addr)
+	mtu := node.mtuFor(addr)
+
+	var inFlight []batchInFlight
+	messages := make([]ipv4.Message, 0, len(requests))
+
+	for i, req := range requests {
+		thisCall := node.nextCall(addr)
+
+		query := Query{ProcedureName: req.Procedure, MessageID: thisCall.MessageID}
+		argData, err := codec.Encode(req.Args)
+		if err != nil {
+			responses[i].Err = err
+			continue
+		}
+		query.ProcedureData = argData
+
+		messageData, err := envelopeCodec.Encode(Message{Query: &query})
+		if err != nil {
+			responses[i].Err = err
+			continue
+		}
+
+		// Frame the same way Call does: reliability-framed (with its CRC32) when
+		// Node.ReliableUDP is set, since the receiver's processPacket routes every
+		// datagram from such a node through processReliablePacket regardless of how
+		// it got there, or plain big-endian-prefixed otherwise.
+		var wireData []byte
+		if node.ReliableUDP {
+			wireData = frameReliable(msgQuery, thisCall.MessageID, messageData)
+		} else {
+			wireData, err = encodeIntoBigEndian(bytes.NewBuffer(messageData))
+			if err != nil {
+				responses[i].Err = err
+				continue
+			}
+		}
+
+		if uint32(len(wireData)+1) > mtu {
+			// Too large for one datagram; Call will fragment it instead.
+			responses[i].Err = node.Call(ctx, req.Procedure, addr, req.Args, req.Reply)
+			continue
+		}
+
+		datagram := make([]byte, 1+len(wireData))
+		datagram[0] = wireWhole
+		copy(datagram[1:], wireData)
+
+		responseChan := make(responseChannel, 1)
+		node.pending[thisCall] = responseChan
+
+		inFlight = append(inFlight, batchInFlight{index: i, procedure: req.Procedure, thisCall: thisCall, responseChan: responseChan, reply: req.Reply})
+		messages = append(messages, ipv4.Message{Buffers: [][]byte{datagram}, Addr: addr})
+	}
+
+	pconn := ipv4.NewPacketConn(node.connection)
+	node.sendingMutex.Lock()
+	for start := 0; start < len(messages); start += batchSize {
+		end := start + batchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		if sent, err := pconn.WriteBatch(messages[start:end], 0); err != nil {
+			// sent may be less than len(messages[start:end]): WriteBatch can fail after
+			// writing some of the messages, not just when batching isn't supported at
+			// all. Only resend the ones it didn't get to, so a non-idempotent procedure
+			// isn't invoked twice for a peer not covered by ReliableUDP's dedup.
+			fmt.Println("WriteBatch failed, falling back to serial sends:", err)
+			for _, msg := range messages[start+sent : end] {
+				node.connection.WriteTo(msg.Buffers[0], msg.Addr)
+			}
+		}
+	}
+	node.sendingMutex.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(inFlight))
+	for _, item := range inFlight {
+		go func(item batchInFlight) {
+			defer wg.Done()
+			defer func() {
+				node.pendingMutex.Lock()
+				delete(node.pending, item.thisCall)
+				node.pendingMutex.Unlock()
+			}()
+			select {
+			case result := <-item.responseChan:
+				if remoteErr := remoteErrorFor(item.procedure, result); remoteErr != nil {
+					responses[item.index].Err = remoteErr
+				} else {
+					responses[item.index].Err = codec.Decode(result.ReturnData, item.reply)
+				}
+			case <-ctx.Done():
+				responses[item.index].Err = ctxErr(ctx)
+			}
+		}(item)
+	}
+	wg.Wait()
+
+	return responses
+}
+
+// listenAndServeBatch reads up to batchSize datagrams per ReadBatch (recvmmsg) syscall and
+// dispatches each exactly as ListenAndServe's serial loop would.
+func (node *Node) listenAndServeBatch() error {
+	if node.serving {
+		return fmt.Errorf("qrp: already serving")
+	}
+	node.serving = true
+	defer node.connection.Close()
+	defer node.cancel()
+	defer func() { node.serving = false }()
+
+	pconn := ipv4.NewPacketConn(node.connection)
+
+	buffers := make([][]byte, batchSize)
+	messages := make([]ipv4.Message, batchSize)
+	for i := range messages {
+		buffers[i] = make([]byte, node.connectionMTU)
+		messages[i].Buffers = [][]byte{buffers[i]}
+	}
+
+	for {
+		n, err := pconn.ReadBatch(messages, 0)
+		if err != nil {
+			println("Error reading batch from connection")
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			bytesRead := messages[i].N
+			fromAddr := messages[i].Addr
+			if bytesRead <= 0 {
+				continue
+			}
+
+			packet := make([]byte, bytesRead)
+			copy(packet, buffers[i][:bytesRead])
+
+			go func(packet []byte, bytesRead int, fromAddr net.Addr) {
+				if err := node.processPacket(&packet, bytesRead, fromAddr); err != nil {
+					fmt.Printf("Error processing message: %s\n", err.Error())
+				}
+			}(packet, bytesRead, fromAddr)
+		}
+	}
+}
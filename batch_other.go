@@ -0,0 +1,23 @@
+//go:build !linux
+
+package qrp
+
+import (
+	"context"
+	"net"
+)
+
+// callBatch is the non-Linux fallback: there's no portable recvmmsg/sendmmsg equivalent, so
+// requests are simply issued one at a time through Call.
+func (node *Node) callBatch(ctx context.Context, addr net.Addr, requests []BatchRequest) []BatchResponse {
+	responses := make([]BatchResponse, len(requests))
+	for i, req := range requests {
+		responses[i].Err = node.Call(ctx, req.Procedure, addr, req.Args, req.Reply)
+	}
+	return responses
+}
+
+// listenAndServeBatch is the non-Linux fallback: identical to ListenAndServe.
+func (node *Node) listenAndServeBatch() error {
+	return node.ListenAndServe()
+}
@@ -0,0 +1,82 @@
+package qrp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zeebo/bencode"
+)
+
+// Codec marshals and unmarshals procedure arguments and reply values. Node routes all
+// application-level encoding through the Codec supplied to NewNode, so the wire framing
+// (Message/Query/Reply, big-endian header) stays independent of the payload format.
+// After the Version handshake with a peer, the codec negotiated with that peer is used:
+// the NewNode codec if it is one of the named codecs in version.go and the peer knows it,
+// otherwise the first entry of codecPreference the peer knows.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// BencodeCodec is the original wire format; CreateNode/CreateNodeUDP still default to it.
+type BencodeCodec struct{}
+
+func (BencodeCodec) Encode(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := bencode.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (BencodeCodec) Decode(data []byte, v interface{}) error {
+	return bencode.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// GobCodec encodes procedure arguments and reply values with encoding/gob
+type GobCodec struct{}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec encodes procedure arguments and reply values as JSON
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec encodes procedure arguments and reply values as Protocol Buffers.
+// v must implement proto.Message.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Encode(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, &CodecTypeError{Codec: "protobuf", Value: v}
+	}
+	return proto.Marshal(message)
+}
+
+func (ProtobufCodec) Decode(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return &CodecTypeError{Codec: "protobuf", Value: v}
+	}
+	return proto.Unmarshal(data, message)
+}
@@ -0,0 +1,49 @@
+package qrp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCallRespectsDeadlineOnUnresponsivePeer reproduces the hang where Call's automatic
+// first-contact handshake (node.Version) used to run with context.Background() instead of
+// the caller's ctx: a Call to an address nobody is listening on must return ctx.Err() once
+// the deadline passes, not block forever waiting on a handshake reply that will never come.
+func TestCallRespectsDeadlineOnUnresponsivePeer(t *testing.T) {
+	// Bind and immediately close a socket so its address is valid but unreachable: nothing
+	// is listening there, and the datagrams are silently dropped rather than refused.
+	deadConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	deadAddr := deadConn.LocalAddr()
+	deadConn.Close()
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer clientConn.Close()
+	err, client := CreateNode(clientConn, 1500)
+	if err != nil {
+		t.Fatalf("CreateNode: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var reply string
+	arg := "hello"
+	err = client.Call(ctx, "Echo", deadAddr, &arg, &reply)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected Call to a non-listening address to fail once the deadline passes")
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("Call took %s to return after a 300ms deadline; the first-contact handshake isn't honoring ctx", elapsed)
+	}
+}
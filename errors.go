@@ -0,0 +1,157 @@
+package qrp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Returned by Call/CallBatch in place of ctx.Err() when ctx's deadline passed, rather than
+// being explicitly canceled. Unwraps to context.DeadlineExceeded.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "qrp: call timed out"
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ctxErr turns ctx.Err() into a *TimeoutError when ctx was done because its deadline
+// passed, leaving an explicit cancellation (context.Canceled) as-is.
+func ctxErr(ctx context.Context) error {
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		return &TimeoutError{Err: err}
+	}
+	return err
+}
+
+// Returned by processQuery when the remote node has no procedure registered under that name
+type BadProcedureError struct {
+	ProcedureName string
+}
+
+func (e *BadProcedureError) Error() string {
+	return fmt.Sprintf("qrp: unknown procedure %q", e.ProcedureName)
+}
+
+// Returned by processMessage when a Message has neither Query nor Reply set
+type InvalidMessageError struct{}
+
+func (e *InvalidMessageError) Error() string {
+	return "qrp: invalid message"
+}
+
+// Returned by processReply when a reply's MessageID doesn't match a pending call
+type InvalidMessageMappingError struct {
+	MessageID uint32
+}
+
+func (e *InvalidMessageMappingError) Error() string {
+	return fmt.Sprintf("qrp: no pending call for message id %d", e.MessageID)
+}
+
+// Returned by a Codec when given a value it cannot encode/decode, e.g. ProtobufCodec
+// given a value that doesn't implement proto.Message
+type CodecTypeError struct {
+	Codec string
+	Value interface{}
+}
+
+func (e *CodecTypeError) Error() string {
+	return fmt.Sprintf("qrp: %s codec cannot handle value of type %T", e.Codec, e.Value)
+}
+
+// Returned by Version when the peer's advertised version range doesn't overlap ours
+type UnsupportedVersionError struct {
+	Requested uint32
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("qrp: peer requested unsupported protocol version %d", e.Requested)
+}
+
+// Returned by Version when the peer chose a codec we don't recognize
+type UnsupportedCodecError struct {
+	Name string
+}
+
+func (e *UnsupportedCodecError) Error() string {
+	return fmt.Sprintf("qrp: peer chose unsupported codec %q", e.Name)
+}
+
+// Returned by the reliability layer (Node.ReliableUDP) when a frame's length or CRC32
+// doesn't check out; the datagram is dropped rather than handed to the codec
+type CorruptFrameError struct{}
+
+func (e *CorruptFrameError) Error() string {
+	return "qrp: corrupt reliable frame"
+}
+
+// Returned by Call when Node.ReliableUDP is set and a query goes unacked after
+// exhausting its retransmit attempts
+type MaxRetriesExceededError struct {
+	Retries int
+}
+
+func (e *MaxRetriesExceededError) Error() string {
+	return fmt.Sprintf("qrp: query unacked after %d retransmits", e.Retries)
+}
+
+// Returned when a message's encoded size exceeds Node.MaxMessageSize, or is too large to
+// fragment within the uint16 fragment-count limit
+type MessageTooLargeError struct {
+	Size           int
+	MaxMessageSize int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("qrp: message of %d bytes exceeds MaxMessageSize of %d", e.Size, e.MaxMessageSize)
+}
+
+// Well-known conditions a remote handler's error can be tagged with on the wire (see
+// Reply.ErrorCode), so a caller can errors.Is against them regardless of the handler's
+// exact message text. A handler error with no recognized code unwraps to nil.
+var (
+	ErrUnknownProcedure = errors.New("qrp: unknown procedure")
+	ErrBadArgs          = errors.New("qrp: bad arguments")
+	ErrHandlerPanic     = errors.New("qrp: handler panicked")
+)
+
+// The wire representation of the sentinels above, carried on Reply.ErrorCode
+const (
+	codeUnknownProcedure = "unknown_procedure"
+	codeBadArgs          = "bad_args"
+	codeHandlerPanic     = "handler_panic"
+)
+
+// errorCodes maps a Reply.ErrorCode back to the sentinel it stands for
+var errorCodes = map[string]error{
+	codeUnknownProcedure: ErrUnknownProcedure,
+	codeBadArgs:          ErrBadArgs,
+	codeHandlerPanic:     ErrHandlerPanic,
+}
+
+// Returned by Call when the peer answered with a Reply.Error: the remote handler returned a
+// non-nil error or panicked, the arguments failed to decode there, or no procedure of that
+// name is registered there (the peer's BadProcedureError arrives as a RemoteError coded
+// ErrUnknownProcedure). It is distinct from a local decode/transport failure or a
+// TimeoutError. Unwrap returns one of the Errxxx sentinels above
+// when the server tagged the error with a recognized code, or nil for a plain handler error.
+type RemoteError struct {
+	Procedure string
+	Message   string
+	Code      error
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("qrp: remote error calling %q: %s", e.Procedure, e.Message)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Code
+}
@@ -0,0 +1,40 @@
+package qrp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCtxErrWrapsDeadlineExceeded checks that a timed-out context surfaces as a
+// *TimeoutError callers can errors.As against, while an explicitly canceled context is
+// left as context.Canceled rather than misreported as a timeout.
+func TestCtxErrWrapsDeadlineExceeded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := ctxErr(ctx)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("ctxErr(deadline-exceeded context) = %v, want a *TimeoutError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("TimeoutError should unwrap to context.DeadlineExceeded")
+	}
+}
+
+func TestCtxErrLeavesCancellationAlone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := ctxErr(ctx)
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		t.Fatalf("ctxErr(canceled context) = %v, want context.Canceled, not a *TimeoutError", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ctxErr(canceled context) = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,177 @@
+package qrp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Marker byte prefixing every datagram qrp sends, distinguishing a complete frame
+// (wireWhole) from one piece of a message split across several datagrams (wireFragment).
+const (
+	wireWhole    byte = 0
+	wireFragment byte = 1
+)
+
+// Size in bytes of a wireFragment datagram's header, after the marker byte: messageID,
+// fragIndex, fragCount, totalLen.
+const fragmentHeaderSize = 4 + 2 + 2 + 4
+
+// How long a partially-reassembled message is kept before being dropped as stale.
+const fragmentReapTimeout = 30 * time.Second
+
+// DefaultMaxMessageSize is the MaxMessageSize a Node is given by NewNode; callers that
+// expect larger payloads can raise it.
+const DefaultMaxMessageSize = 1 << 20 // 1 MiB
+
+// Tracks the fragments received so far for one (addr, messageID) message
+type fragmentAssembly struct {
+	fragCount uint16
+	totalLen  uint32
+	parts     map[uint16][]byte
+	expires   time.Time
+}
+
+// Returns the MTU to size fragments against: the negotiated MTU for addr if a handshake
+// has happened, otherwise the node's own connectionMTU.
+func (node *Node) mtuFor(addr net.Addr) uint32 {
+	node.peersMutex.Lock()
+	defer node.peersMutex.Unlock()
+	if params, ok := node.peers[addr.String()]; ok && params.MTU > 0 {
+		return params.MTU
+	}
+	return node.connectionMTU
+}
+
+// sendFramed sends data (an already codec/reliability-framed message) to addr, splitting
+// it into fragments if it doesn't fit in a single datagram at the negotiated MTU. Returns
+// MessageTooLargeError if data exceeds node.MaxMessageSize.
+func (node *Node) sendFramed(messageID uint32, data []byte, addr net.Addr) error {
+	if node.MaxMessageSize > 0 && uint32(len(data)) > node.MaxMessageSize {
+		return &MessageTooLargeError{Size: len(data), MaxMessageSize: int(node.MaxMessageSize)}
+	}
+
+	mtu := int(node.mtuFor(addr))
+	if len(data)+1 <= mtu {
+		whole := make([]byte, 0, len(data)+1)
+		whole = append(whole, wireWhole)
+		whole = append(whole, data...)
+		return node.writeDatagram(whole, addr)
+	}
+
+	fragmentPayloadSize := mtu - 1 - fragmentHeaderSize
+	if fragmentPayloadSize <= 0 {
+		// MTU too small to carry even a one-byte fragment; nothing sane to do.
+		return &MessageTooLargeError{Size: len(data), MaxMessageSize: int(node.MaxMessageSize)}
+	}
+
+	fragCount := (len(data) + fragmentPayloadSize - 1) / fragmentPayloadSize
+	if fragCount > 1<<16-1 {
+		return &MessageTooLargeError{Size: len(data), MaxMessageSize: int(node.MaxMessageSize)}
+	}
+
+	for i := 0; i < fragCount; i++ {
+		start := i * fragmentPayloadSize
+		end := start + fragmentPayloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[start:end]
+
+		frame := make([]byte, 1+fragmentHeaderSize, 1+fragmentHeaderSize+len(chunk))
+		frame[0] = wireFragment
+		binary.BigEndian.PutUint32(frame[1:5], messageID)
+		binary.BigEndian.PutUint16(frame[5:7], uint16(i))
+		binary.BigEndian.PutUint16(frame[7:9], uint16(fragCount))
+		binary.BigEndian.PutUint32(frame[9:13], uint32(len(data)))
+		frame = append(frame, chunk...)
+
+		if err := node.writeDatagram(frame, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDatagram sends a single already-framed datagram to addr
+func (node *Node) writeDatagram(data []byte, addr net.Addr) error {
+	node.sendingMutex.Lock()
+	_, err := node.connection.WriteTo(data, addr)
+	node.sendingMutex.Unlock()
+	return err
+}
+
+// reassemble strips the wireWhole/wireFragment marker from a received datagram, returning
+// the complete frame once all of a message's fragments have arrived. ok is false when data
+// was only one piece of a still-incomplete message, in which case complete is nil and the
+// caller has nothing further to process yet.
+func (node *Node) reassemble(data []byte, addr net.Addr) (complete []byte, ok bool, err error) {
+	if len(data) < 1 {
+		return nil, false, &InvalidMessageError{}
+	}
+	marker, body := data[0], data[1:]
+	if marker == wireWhole {
+		return body, true, nil
+	}
+	if marker != wireFragment {
+		return nil, false, &InvalidMessageError{}
+	}
+	if len(body) < fragmentHeaderSize {
+		return nil, false, &CorruptFrameError{}
+	}
+
+	messageID := binary.BigEndian.Uint32(body[0:4])
+	fragIndex := binary.BigEndian.Uint16(body[4:6])
+	fragCount := binary.BigEndian.Uint16(body[6:8])
+	totalLen := binary.BigEndian.Uint32(body[8:12])
+	chunk := body[fragmentHeaderSize:]
+
+	// totalLen comes straight off the wire, ahead of the CRC32 the reliability layer would
+	// otherwise catch a corrupt/adversarial header with; reject it before it drives the
+	// complete := make([]byte, 0, totalLen) allocation below, or an attacker could claim an
+	// arbitrary totalLen (up to the uint32 max) in a single datagram and exhaust memory.
+	if node.MaxMessageSize > 0 && totalLen > node.MaxMessageSize {
+		return nil, false, &MessageTooLargeError{Size: int(totalLen), MaxMessageSize: int(node.MaxMessageSize)}
+	}
+
+	key := call{MessageID: messageID, Addr: addr}
+
+	node.fragmentsMutex.Lock()
+	defer node.fragmentsMutex.Unlock()
+
+	node.reapStaleFragmentsLocked()
+
+	assembly, exists := node.fragments[key]
+	if !exists {
+		assembly = &fragmentAssembly{
+			fragCount: fragCount,
+			totalLen:  totalLen,
+			parts:     make(map[uint16][]byte),
+		}
+		node.fragments[key] = assembly
+	}
+	assembly.expires = time.Now().Add(fragmentReapTimeout)
+	assembly.parts[fragIndex] = chunk
+
+	if len(assembly.parts) < int(assembly.fragCount) {
+		return nil, false, nil
+	}
+
+	complete = make([]byte, 0, assembly.totalLen)
+	for i := uint16(0); i < assembly.fragCount; i++ {
+		complete = append(complete, assembly.parts[i]...)
+	}
+	delete(node.fragments, key)
+	return complete, true, nil
+}
+
+// reapStaleFragmentsLocked drops partially-reassembled messages that haven't seen a new
+// fragment in fragmentReapTimeout. Must be called with fragmentsMutex held.
+func (node *Node) reapStaleFragmentsLocked() {
+	now := time.Now()
+	for key, assembly := range node.fragments {
+		if now.After(assembly.expires) {
+			delete(node.fragments, key)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package qrp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNodeForFragments(t *testing.T) *Node {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	err, node := CreateNode(conn, 64) // small MTU so sendFramed has to fragment
+	if err != nil {
+		t.Fatalf("CreateNode: %v", err)
+	}
+	return node
+}
+
+// fragmentPayloadFor splits data into wireFragment datagrams the same way sendFramed does,
+// without going over a real socket, so reassemble can be driven deterministically.
+func fragmentPayloadFor(messageID uint32, mtu int, data []byte) [][]byte {
+	fragmentPayloadSize := mtu - 1 - fragmentHeaderSize
+	fragCount := (len(data) + fragmentPayloadSize - 1) / fragmentPayloadSize
+
+	datagrams := make([][]byte, 0, fragCount)
+	for i := 0; i < fragCount; i++ {
+		start := i * fragmentPayloadSize
+		end := start + fragmentPayloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[start:end]
+
+		frame := make([]byte, 1+fragmentHeaderSize, 1+fragmentHeaderSize+len(chunk))
+		frame[0] = wireFragment
+		binary.BigEndian.PutUint32(frame[1:5], messageID)
+		binary.BigEndian.PutUint16(frame[5:7], uint16(i))
+		binary.BigEndian.PutUint16(frame[7:9], uint16(fragCount))
+		binary.BigEndian.PutUint32(frame[9:13], uint32(len(data)))
+		frame = append(frame, chunk...)
+		datagrams = append(datagrams, frame)
+	}
+	return datagrams
+}
+
+// TestReassembleRoundTrip feeds reassemble the fragments of a message much larger than a
+// single datagram, checking it reconstructs the original bytes once the last fragment
+// arrives and is a no-op (ok == false) until then.
+func TestReassembleRoundTrip(t *testing.T) {
+	node := newTestNodeForFragments(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	data := bytes.Repeat([]byte("qrp-fragment-payload-"), 50) // well over a 64-byte MTU
+	fragments := fragmentPayloadFor(1, 64, data)
+	if len(fragments) < 2 {
+		t.Fatalf("expected the test message to need multiple fragments, got %d", len(fragments))
+	}
+
+	var got []byte
+	for i, frame := range fragments {
+		complete, ok, err := node.reassemble(frame, addr)
+		if err != nil {
+			t.Fatalf("reassemble fragment %d: %v", i, err)
+		}
+		if i < len(fragments)-1 {
+			if ok {
+				t.Fatalf("reassemble reported complete after fragment %d of %d", i, len(fragments))
+			}
+			continue
+		}
+		if !ok {
+			t.Fatal("reassemble did not report complete after the last fragment")
+		}
+		got = complete
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("reassembled %d bytes, want %d bytes matching the original", len(got), len(data))
+	}
+
+	node.fragmentsMutex.Lock()
+	count := len(node.fragments)
+	node.fragmentsMutex.Unlock()
+	if count != 0 {
+		t.Errorf("a completed assembly left %d entries in node.fragments", count)
+	}
+}
+
+// TestReassembleWholeMessage checks the non-fragmented (wireWhole) path returns the
+// message immediately without touching node.fragments.
+func TestReassembleWholeMessage(t *testing.T) {
+	node := newTestNodeForFragments(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	datagram := append([]byte{wireWhole}, []byte("small message")...)
+	complete, ok, err := node.reassemble(datagram, addr)
+	if err != nil {
+		t.Fatalf("reassemble: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected a whole message to be immediately complete")
+	}
+	if string(complete) != "small message" {
+		t.Errorf("complete = %q, want %q", complete, "small message")
+	}
+
+	node.fragmentsMutex.Lock()
+	count := len(node.fragments)
+	node.fragmentsMutex.Unlock()
+	if count != 0 {
+		t.Errorf("reassemble of a whole message left %d entries in node.fragments", count)
+	}
+}
+
+// TestReassembleRejectsOversizedTotalLen checks a single hand-crafted fragment claiming a
+// totalLen beyond node.MaxMessageSize is rejected before the complete buffer is allocated,
+// instead of being trusted straight off the wire.
+func TestReassembleRejectsOversizedTotalLen(t *testing.T) {
+	node := newTestNodeForFragments(t)
+	node.MaxMessageSize = 1024
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	frame := make([]byte, 1+fragmentHeaderSize+1)
+	frame[0] = wireFragment
+	binary.BigEndian.PutUint32(frame[1:5], 1)        // messageID
+	binary.BigEndian.PutUint16(frame[5:7], 0)        // fragIndex
+	binary.BigEndian.PutUint16(frame[7:9], 1)        // fragCount
+	binary.BigEndian.PutUint32(frame[9:13], 200<<20) // totalLen: 200MiB, way over MaxMessageSize
+	frame[1+fragmentHeaderSize] = 'x'
+
+	complete, ok, err := node.reassemble(frame, addr)
+	if err == nil {
+		t.Fatal("expected an error for a fragment claiming totalLen over MaxMessageSize")
+	}
+	if ok || complete != nil {
+		t.Fatal("reassemble should not report a complete message for a rejected fragment")
+	}
+
+	node.fragmentsMutex.Lock()
+	count := len(node.fragments)
+	node.fragmentsMutex.Unlock()
+	if count != 0 {
+		t.Errorf("a rejected fragment left %d entries in node.fragments", count)
+	}
+}
+
+// TestReapStaleFragmentsDropsExpiredAssemblies mirrors TestSeenQueriesReap for the
+// fragmentation layer: a partially-reassembled message past fragmentReapTimeout must be
+// dropped so a sender that stops mid-stream doesn't leak memory forever.
+func TestReapStaleFragmentsDropsExpiredAssemblies(t *testing.T) {
+	node := newTestNodeForFragments(t)
+
+	freshKey := call{MessageID: 1, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	staleKey := call{MessageID: 2, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}}
+
+	node.fragmentsMutex.Lock()
+	node.fragments[freshKey] = &fragmentAssembly{fragCount: 2, parts: map[uint16][]byte{0: []byte("a")}, expires: time.Now().Add(fragmentReapTimeout)}
+	node.fragments[staleKey] = &fragmentAssembly{fragCount: 2, parts: map[uint16][]byte{0: []byte("b")}, expires: time.Now().Add(-time.Second)}
+	node.reapStaleFragmentsLocked()
+	_, freshStillPresent := node.fragments[freshKey]
+	_, staleStillPresent := node.fragments[staleKey]
+	node.fragmentsMutex.Unlock()
+
+	if !freshStillPresent {
+		t.Error("reapStaleFragmentsLocked removed a non-expired assembly")
+	}
+	if staleStillPresent {
+		t.Error("reapStaleFragmentsLocked left an expired assembly in place")
+	}
+}
@@ -0,0 +1,34 @@
+package qrp
+
+import (
+	"github.com/zeebo/bencode"
+)
+
+// envelopeCodec frames every Message regardless of the codec negotiated with the peer.
+// Only Query.ProcedureData/Reply.ReturnData are encoded with the negotiated codec; the
+// envelope itself has to be decodable before a handshake has even picked a codec (the
+// Version handshake is itself a Message), so it stays on this fixed, stable wire format.
+var envelopeCodec Codec = BencodeCodec{}
+
+// The wire envelope exchanged between nodes. Exactly one of Query or Reply is set.
+type Message struct {
+	Query *Query `bencode:"q,omitempty"`
+	Reply *Reply `bencode:"r,omitempty"`
+}
+
+// A request to invoke 'ProcedureName' on the remote node. ProcedureData holds the
+// arguments as encoded by the caller's Codec; it is decoded lazily, once the handler
+// (and therefore the expected argument type) is known.
+type Query struct {
+	MessageID     uint32 `bencode:"id"`
+	ProcedureName string `bencode:"proc"`
+	ProcedureData []byte `bencode:"data"`
+}
+
+// The response to a Query
+type Reply struct {
+	MessageID  uint32             `bencode:"id"`
+	ReturnData bencode.RawMessage `bencode:"data"`           // Encoded reply value, decoded lazily by the caller's codec
+	Error      *string            `bencode:"err,omitempty"`  // Set instead of a meaningful ReturnData when the handler returned a non-nil error or panicked, or the query named an unknown procedure or carried undecodable arguments
+	ErrorCode  string             `bencode:"code,omitempty"` // One of the codeXxx wire codes in errors.go, empty for a plain handler error
+}
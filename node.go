@@ -1,9 +1,8 @@
 package qrp
 
-// TOOD: Make query decoding more efficient by setting Query.ProcedureArguments as a bencode.RawMessage
-
 import (
 	"bytes"
+	"context"
 	"github.com/zeebo/bencode" // BEncode
 	"net"
 	"sync"
@@ -20,24 +19,66 @@ type procedure struct {
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	Receiver reflect.Value
+	HasContext bool // true if Method's first argument (after the receiver) is a context.Context
 }
 
+// The reflect.Type of context.Context, used by register to detect handlers that want
+// a context as their first argument
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// The reflect.Type of error, used by register to verify a handler's sole return value
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
 // Our local node
 type Node struct {
 	connection net.PacketConn
 	connectionMTU uint32
+	codec Codec // Marshals/unmarshals procedure arguments and reply values until a peer's codec is negotiated; defaults to BencodeCodec
 	procedures map[string] *procedure // Registered procedures on the node
 	pending map[call] responseChannel // A map of calls to queries pending responses
 	messageID uint32
-	
+	peers map[string] *peerParams // Negotiated version/codec/MTU per peer address, keyed on addr.String()
+	ctx context.Context // Canceled when the node stops serving; handed to context-aware handlers
+	cancel context.CancelFunc
+
+	ReliableUDP bool // When true, Call retransmits queries until acked and frames carry a CRC32 (see reliable.go)
+	acks map[call] chan struct{} // Ack channels for in-flight reliable queries, keyed like pending
+	seenQueries map[call] time.Time // Dedups retransmitted queries so handlers aren't invoked twice; value is the expiry, reaped the same way as fragments
+
+	MaxMessageSize uint32 // Largest encoded message Call/processQuery will send; see fragment.go
+	fragments map[call] *fragmentAssembly // In-progress reassembly of fragmented messages, keyed on (addr, messageID)
+
+	bufferPool sync.Pool // Reusable read buffers for ListenAndServe (and ListenAndServeBatch on non-Linux platforms, where it is ListenAndServe); see newBuffer/putBuffer
+
 	pendingMutex sync.Mutex // to protect pending, messageID
 	sendingMutex sync.Mutex
 	proceduresMutex sync.Mutex
-	
+	peersMutex sync.Mutex // to protect peers
+	acksMutex sync.Mutex // to protect acks
+	seenMutex sync.Mutex // to protect seenQueries
+	fragmentsMutex sync.Mutex // to protect fragments
+
 	serving bool
 }
 
-type responseChannel chan bencode.RawMessage
+// The payload delivered through a responseChannel for a completed call: either return data
+// to decode, or a handler-reported error (see remoteErrorFor) to surface as a RemoteError.
+type callResult struct {
+	ReturnData bencode.RawMessage
+	Error      *string
+	ErrorCode  string
+}
+
+type responseChannel chan callResult
+
+// remoteErrorFor turns a callResult carrying a handler error into a *RemoteError, or returns
+// nil if result represents a successful reply.
+func remoteErrorFor(procedure string, result callResult) error {
+	if result.Error == nil {
+		return nil
+	}
+	return &RemoteError{Procedure: procedure, Message: *result.Error, Code: errorCodes[result.ErrorCode]}
+}
 
 type call struct {
 	MessageID uint32
@@ -45,6 +86,7 @@ type call struct {
 }
 
 // Creates a node using UDP (IPv6), returning an error if failure
+// The node defaults to the bencode codec; use NewNode to pick a different one.
 func CreateNodeUDP(addr string, mtu uint32) (error, *Node) {
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
@@ -53,29 +95,60 @@ func CreateNodeUDP(addr string, mtu uint32) (error, *Node) {
 	return CreateNode(conn, mtu)
 }
 
-// Creates a node that performs IO on connection
+// Creates a node that performs IO on connection, using the bencode codec
 // Returns an error if failure
 func CreateNode(connection net.PacketConn, mtu uint32) (error, *Node) {
+	return NewNode(connection, mtu, BencodeCodec{})
+}
+
+// Creates a node that performs IO on connection, marshaling procedure arguments and reply
+// values with codec. Returns an error if failure.
+func NewNode(connection net.PacketConn, mtu uint32, codec Codec) (error, *Node) {
+	if codec == nil {
+		codec = BencodeCodec{}
+	}
+
 	// Allocation
 	procedures := make(map[string]*procedure)
 	pending := make(map[call] responseChannel)
+	peers := make(map[string] *peerParams)
+	acks := make(map[call] chan struct{})
+	seenQueries := make(map[call] time.Time)
+	fragments := make(map[call] *fragmentAssembly)
 	sendingMutex, pendingMutex, proceduresMutex := new(sync.Mutex), new(sync.Mutex), new(sync.Mutex)
-	
+
 	// Initialize messageID to random value
 	messageID := uint32(time.Now().Nanosecond())
+	ctx, cancel := context.WithCancel(context.Background())
 	node := Node {
 		connection: connection,
 		connectionMTU: mtu,
-		procedures: procedures, 
-		pending: pending, 
+		codec: codec,
+		procedures: procedures,
+		pending: pending,
+		peers: peers,
+		acks: acks,
+		seenQueries: seenQueries,
+		MaxMessageSize: DefaultMaxMessageSize,
+		fragments: fragments,
+		bufferPool: sync.Pool{New: func() interface{} { return make([]byte, mtu) }},
+		ctx: ctx,
+		cancel: cancel,
 		messageID: messageID,
-		sendingMutex: *sendingMutex, 
+		sendingMutex: *sendingMutex,
 		pendingMutex: *pendingMutex,
 		proceduresMutex: *proceduresMutex,
 		}
+	node.Register(&versionHandler{node: &node})
 	return nil, &node
 }
 
+// Returns the context handed to context-aware procedure handlers; canceled once the
+// node stops serving (see ListenAndServe).
+func (node *Node) servingCtx() context.Context {
+	return node.ctx
+}
+
 // Listens and Serves, returning an error on failure
 func (node *Node) ListenAndServe() (err error) {
 	if node.serving {
@@ -83,58 +156,136 @@ func (node *Node) ListenAndServe() (err error) {
 	}
 	node.serving = true
 	defer node.connection.Close()
+	defer node.cancel()
 	defer func(){ node.serving = false }()
 	
 	for {
-		// Buffer size is 512 because it's the largest size without possible fragmentation
-		//
-		// IPv4 and IPv6 define minimum reassembly buffer size, the minimum datagram size that we are guaranteed
-		// any implementation must support. For IPv4, this is 576 bytes. IPv6 raises this to 1,500 bytes 
-		// ~ UNIX Network Programming, Volume 2, Second Edition: Interprocess Communication
-		
-		buffer := make([]byte, node.connectionMTU, node.connectionMTU)
+		// Buffer comes from node.bufferPool rather than a fresh make() per packet; see
+		// newBuffer/putBuffer in batch.go.
+		buffer := node.newBuffer()
 
 		// Read a packet into the buffer
 		bytesRead, fromAddr, err := node.connection.ReadFrom(buffer)
 		if err != nil {
+			node.putBuffer(buffer)
 			println("Error reading from connection")
 			return err
 		}
-		
+
 		// If we read a packet
 		if bytesRead > 0 {
+			// Copy out of the pooled buffer so it can go back in the pool right away,
+			// instead of staying pinned until processing (which may outlive this read,
+			// e.g. while waiting on fragment reassembly) finishes.
+			packet := make([]byte, bytesRead)
+			copy(packet, buffer[:bytesRead])
+			node.putBuffer(buffer)
+
 			// Process packet
 			go func() {
-				err = node.processPacket(&buffer, bytesRead, fromAddr)
-				if err != nil {
+				if err := node.processPacket(&packet, bytesRead, fromAddr); err != nil {
 					fmt.Printf("Error processing message: %s\n", err.Error())
 				}
 			}()
+		} else {
+			node.putBuffer(buffer)
 		}
 	}
-	
+
 	return nil
 }
 
 // Processes received packets
-func (node *Node) processPacket(data *[]byte, read int, addr net.Addr) (error) {	
-	data_bigEndian, err := decodeIntoBigEndian(bytes.NewBuffer(*data))
+func (node *Node) processPacket(data *[]byte, read int, addr net.Addr) (error) {
+	// Strip the fragmentation marker, reassembling the full frame if data was only one
+	// fragment of it. ok is false while more fragments are still in flight.
+	frameData, ok, err := node.reassemble((*data)[:read], addr)
+	if err != nil {
+		fmt.Println("Error reassembling packet:", err)
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	if node.ReliableUDP {
+		return node.processReliablePacket(frameData, addr)
+	}
+
+	data_bigEndian, err := decodeIntoBigEndian(bytes.NewBuffer(frameData))
 	if err != nil {
 		fmt.Println("Couldn't read packet into BigEndian:", err)
 		return err
 	}
-	
-	// Unmarshal BigEndian BEncode into struct
-	bencodeD := bencode.NewDecoder(bytes.NewBuffer(data_bigEndian))
+
+	// Unmarshal the envelope with the fixed envelopeCodec; the negotiated codec only
+	// applies to Query.ProcedureData/Reply.ReturnData below
 	var message Message
-	if err := bencodeD.Decode(&message); err != nil {
+	if err := envelopeCodec.Decode(data_bigEndian, &message); err != nil {
 		//return err
 	}
-	
+
 	// Further processing
 	return node.processMessage(&message, addr)
 }
 
+// Processes packets framed by the reliability layer (Node.ReliableUDP); see frameReliable
+// for the wire layout of msgQuery/msgReply/msgAck/msgNack frames.
+func (node *Node) processReliablePacket(data []byte, addr net.Addr) error {
+	kind, messageID, payload, err := parseReliableFrame(data)
+	if err != nil {
+		fmt.Println("Dropping corrupt reliable frame:", err)
+		return err
+	}
+
+	switch kind {
+	case msgAck:
+		node.acksMutex.Lock()
+		ackChan := node.acks[call{MessageID: messageID, Addr: addr}]
+		node.acksMutex.Unlock()
+		if ackChan != nil {
+			select {
+			case ackChan <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+
+	case msgNack:
+		fmt.Printf("Peer %s nacked message %d\n", addr, messageID)
+		return nil
+
+	case msgQuery:
+		node.sendAck(msgAck, messageID, addr)
+
+		dedupKey := call{MessageID: messageID, Addr: addr}
+		node.seenMutex.Lock()
+		node.reapStaleSeenQueriesLocked()
+		_, alreadySeen := node.seenQueries[dedupKey]
+		node.seenQueries[dedupKey] = time.Now().Add(seenQueryReapTimeout)
+		node.seenMutex.Unlock()
+		if alreadySeen {
+			// The client retransmitted before our first ack arrived; the handler
+			// already ran once for this messageID, so don't run it again.
+			return nil
+		}
+
+	case msgReply:
+		// Falls through to decoding below. Replies aren't deduped: Call only
+		// retransmits the query, never the reply.
+
+	default:
+		return &InvalidMessageError{}
+	}
+
+	var message Message
+	if err := envelopeCodec.Decode(payload, &message); err != nil {
+		node.sendAck(msgNack, messageID, addr)
+		return err
+	}
+	return node.processMessage(&message, addr)
+}
+
 // Processes raw messages
 func (node *Node) processMessage(message *Message, addr net.Addr) (error) {
 	if query := message.Query; query != nil {
@@ -152,89 +303,145 @@ func (node *Node) processMessage(message *Message, addr net.Addr) (error) {
 // Processes received queries
 func (node *Node) processQuery(query *Query, addr net.Addr) (error) {
 	procedureName := query.ProcedureName
-	if procedure := node.procedures[procedureName]; procedure != nil {
-		method := procedure.Method
-		function := method.Func
-		
-		// Initialize value
-		argValue, replyValue := reflect.New(procedure.ArgType.Elem()), reflect.New(procedure.ReplyType.Elem())		
-		
-		// Set value of arg
-		argsReader := bytes.NewReader(query.ProcedureData)
-		argsDecoder := bencode.NewDecoder(argsReader)
-		err := argsDecoder.Decode(argValue.Interface())
-		if err != nil {
-			fmt.Printf("Error decoding procedure data into value: %s\n", err)
-		}
-		
-		// Invoke the function
-		function.Call([]reflect.Value{procedure.Receiver, argValue, replyValue})
-		
-		// Create reply
-		reply := Reply { MessageID: query.MessageID }
-		argsBuf := new(bytes.Buffer) 
-		argsEncoder := bencode.NewEncoder(argsBuf)
-		argsEncoder.Encode(replyValue.Interface())
-		reply.ReturnData, err = encodeIntoBigEndian(argsBuf)
-		
-		if err != nil {
-			fmt.Printf("Error encoding reply return data: %s\n", err)
-			return err
+	codec := node.codecFor(addr)
+
+	procedure := node.procedures[procedureName]
+	if procedure == nil {
+		err := &BadProcedureError{procedureName}
+		node.sendErrorReply(query.MessageID, codeUnknownProcedure, err, addr)
+		return err
+	}
+
+	method := procedure.Method
+	function := method.Func
+
+	// Initialize value
+	argValue, replyValue := reflect.New(procedure.ArgType.Elem()), reflect.New(procedure.ReplyType.Elem())
+
+	// Set value of arg, lazily decoding the raw procedure data with the negotiated
+	// codec now that the handler's argument type is known
+	if err := codec.Decode(query.ProcedureData, argValue.Interface()); err != nil {
+		wrapped := fmt.Errorf("qrp: decoding arguments for %q: %w", procedureName, err)
+		node.sendErrorReply(query.MessageID, codeBadArgs, wrapped, addr)
+		return wrapped
+	}
+
+	// Invoke the function. qrp doesn't carry the caller's context over the wire, so a
+	// handler that asks for one gets a fresh context bound to this node's lifetime,
+	// canceled when the node stops serving. A panic inside the handler is recovered by
+	// invokeHandler rather than crashing this goroutine.
+	callArgs := []reflect.Value{procedure.Receiver, argValue, replyValue}
+	if procedure.HasContext {
+		callArgs = []reflect.Value{procedure.Receiver, reflect.ValueOf(node.servingCtx()), argValue, replyValue}
+	}
+	handlerErr, panicErr := node.invokeHandler(function, callArgs)
+	if panicErr != nil {
+		node.sendErrorReply(query.MessageID, codeHandlerPanic, panicErr, addr)
+		return panicErr
+	}
+
+	// A successful handshake negotiates the codec/MTU we should use with addr from
+	// here on, same as the client side does in Node.Version
+	if procedureName == versionProcedure && handlerErr == nil {
+		versionReply := replyValue.Interface().(*VersionReply)
+		if negotiatedCodec, ok := namedCodecs[versionReply.Codec]; ok {
+			node.peersMutex.Lock()
+			node.peers[addr.String()] = &peerParams{Version: versionReply.Version, Codec: negotiatedCodec, MTU: versionReply.MTU}
+			node.peersMutex.Unlock()
 		}
-		
-		// Create message
-		message := Message { Reply: &reply }
-		
-		// Encode message
-		messageBuf := new(bytes.Buffer)
-		messageEncoder := bencode.NewEncoder(messageBuf)
-		err = messageEncoder.Encode(message)
-		if err != nil {
-			fmt.Printf("Error encoding reply message into BEncode: %s\n", err)
-			return err
+	}
+
+	// Create reply, tagging it with the handler's own error (if any) alongside whatever
+	// it left in replyValue
+	reply := Reply{MessageID: query.MessageID}
+	if handlerErr != nil {
+		message := handlerErr.Error()
+		reply.Error = &message
+	}
+	var err error
+	reply.ReturnData, err = codec.Encode(replyValue.Interface())
+	if err != nil {
+		fmt.Printf("Error encoding reply return data: %s\n", err)
+		return err
+	}
+
+	if err := node.sendReply(reply, addr); err != nil {
+		fmt.Printf("Error sending reply: %s\n", err)
+		return err
+	}
+
+	return handlerErr
+}
+
+// invokeHandler calls a registered procedure's method, recovering a panic into an
+// ErrHandlerPanic-tagged error instead of letting it escape this goroutine (and, since
+// panics aren't confined to a single goroutine, the whole process), and returning the
+// handler's own error return value.
+func (node *Node) invokeHandler(function reflect.Value, callArgs []reflect.Value) (handlerErr error, panicErr error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
 		}
-		
-		message_bigEndian, err := encodeIntoBigEndian(messageBuf)
+	}()
+	results := function.Call(callArgs)
+	if last := results[len(results)-1]; !last.IsNil() {
+		handlerErr = last.Interface().(error)
+	}
+	return handlerErr, nil
+}
+
+// sendReply encodes reply's envelope with envelopeCodec, frames it per Node.ReliableUDP,
+// and sends it to addr, fragmenting through sendFramed if it doesn't fit in a single
+// datagram. reply.ReturnData was already encoded with the peer's negotiated codec by the
+// caller.
+func (node *Node) sendReply(reply Reply, addr net.Addr) error {
+	message := Message{Reply: &reply}
+	messageData, err := envelopeCodec.Encode(message)
+	if err != nil {
+		return err
+	}
+
+	var wireData []byte
+	if node.ReliableUDP {
+		wireData = frameReliable(msgReply, reply.MessageID, messageData)
+	} else {
+		wireData, err = encodeIntoBigEndian(bytes.NewBuffer(messageData))
 		if err != nil {
-			fmt.Printf("Error encoding reply message into BigEndian: %s\n", err)
 			return err
 		}
-		
-		// Send to host
-		node.sendingMutex.Lock()
-		node.connection.WriteTo(message_bigEndian, addr)
-		node.sendingMutex.Unlock()
-		
-		return nil
-	} else {
-		return &BadProcedureError{ procedureName }
 	}
-	return nil
+
+	return node.sendFramed(reply.MessageID, wireData, addr)
+}
+
+// sendErrorReply answers messageID with a Reply carrying no return value, just handlerErr's
+// message tagged with code, so a caller waiting on it (e.g. one that named an unregistered
+// procedure) gets an answer instead of waiting out its timeout.
+func (node *Node) sendErrorReply(messageID uint32, code string, handlerErr error, addr net.Addr) {
+	message := handlerErr.Error()
+	reply := Reply{MessageID: messageID, Error: &message, ErrorCode: code}
+	if err := node.sendReply(reply, addr); err != nil {
+		fmt.Printf("Error sending error reply: %s\n", err)
+	}
 }
 
 // Processes received replies
 func (node *Node) processReply(reply *Reply, addr net.Addr) (error) {
 	// Construct call
 	chanCall := call { MessageID: reply.MessageID, Addr: addr }
-	
+
 	// Get associated channel
 	responseChan := node.pending[chanCall] // get response channel
-	
-	fmt.Printf("CLIENT:%s\n", node.pending)
-	fmt.Printf("CLIENT:%s\n", chanCall)
-	if responseChan == nil {
-		fmt.Println("CLIENT: Chan is nil")
-	}
-	// The problem is we aren't getting the channel
+
 	if cap(responseChan) == 0 {
 		return &InvalidMessageMappingError { reply.MessageID }
 	}
-	
-	// Send return data
+
+	// Send return data (and any handler error) to the waiting Call
 	node.pendingMutex.Lock()
-	responseChan <- reply.ReturnData
+	responseChan <- callResult{ReturnData: reply.ReturnData, Error: reply.Error, ErrorCode: reply.ErrorCode}
 	node.pendingMutex.Unlock()
-	
+
 	return nil
 }
 
@@ -264,92 +471,175 @@ func (node *Node) nextCall(addr net.Addr) (nextCall call) {
 	return nextCall
 }
 
-func (node *Node) CallUDP(procedure string, addrString string, args interface{}, reply interface{}, timeout int) (err error) {
+func (node *Node) CallUDP(ctx context.Context, procedure string, addrString string, args interface{}, reply interface{}) (err error) {
 	addr, err := net.ResolveUDPAddr("ip", addrString)
 	if err != nil {
 		return err
 	}
-	
-	return node.Call(procedure, addr, args, reply, timeout)
+
+	return node.Call(ctx, procedure, addr, args, reply)
 }
 
-// Tries to call 'procedure' on remote node, with supplied 'args' and allocated return values 'reply'. 
-// 'timeout' can be used to specify a maximum time to wait for a reply (in seconds). If timeout is 0, we wait forever. 
-// The reliability of this completing successfully is dependent on the network protocol (UDP is unreliable)
-// Returns an error if there is a timeout
-func (node *Node) Call(procedure string, addr net.Addr, args interface{}, reply interface{}, timeout int) (err error) {
+// CallUDPTimeout is a thin wrapper around CallUDP for callers not yet using context.Context;
+// timeout is a maximum time to wait for a reply, in seconds. If timeout is 0, we wait forever.
+func (node *Node) CallUDPTimeout(procedure string, addrString string, args interface{}, reply interface{}, timeout int) (err error) {
+	ctx, cancel := contextFromTimeout(timeout)
+	defer cancel()
+	return node.CallUDP(ctx, procedure, addrString, args, reply)
+}
+
+// Tries to call 'procedure' on remote node, with supplied 'args' and allocated return values 'reply'.
+// ctx governs how long Call waits for a reply; once ctx is done, Call stops waiting and returns
+// ctx.Err(), wrapped in a *TimeoutError when ctx's deadline passed. The reliability of this completing successfully is dependent on the network protocol
+// (UDP is unreliable)
+func (node *Node) Call(ctx context.Context, procedure string, addr net.Addr, args interface{}, reply interface{}) (err error) {
+	// Negotiate version/codec/MTU with addr on first contact. The handshake itself is
+	// just another Call, so skip it to avoid recursing on itself.
+	if procedure != versionProcedure {
+		if err := node.Version(ctx, addr); err != nil {
+			return err
+		}
+	}
+	codec := node.codecFor(addr)
+
 	// Get our call, which contains the message ID
 	call := node.nextCall(addr)
-	
-	// Create Query
+
+	// Create Query, encoding args with the peer's negotiated codec
 	query := Query { ProcedureName: procedure, MessageID: call.MessageID }
-	query.constructArgs(args)
-	
-	// Create Message
-	message := Message { Query: &query }
-	
-	// Encode it into BEncode
-	buf := new(bytes.Buffer)
-	bencodeE := bencode.NewEncoder(buf)
-	if err := bencodeE.Encode(message); err != nil {
+	query.ProcedureData, err = codec.Encode(args)
+	if err != nil {
 		return err
 	}
-	
-	buf_bigEndian, err := encodeIntoBigEndian(buf)
+
+	// Create Message
+	message := Message { Query: &query }
+
+	// Encode the envelope with envelopeCodec, not the peer's negotiated codec: Message
+	// only carries raw bytes for the negotiated codec (query.ProcedureData above), and
+	// framing it with e.g. ProtobufCodec would fail since Message isn't a proto.Message
+	messageData, err := envelopeCodec.Encode(message)
 	if err != nil {
 		return err
 	}
-	
+
 	// Create channel for receiving response
 	responseChan := make(responseChannel, 1)
-	
+
 	// Allocate channel
 	node.pending[call] = responseChan
-	
+
 	// Delete channel after exit
 	defer func() {
 		delete(node.pending, call)
 	}()
-	
-	// Send to host
-	node.sendingMutex.Lock()
-	node.connection.WriteTo(buf_bigEndian, addr)
-	node.sendingMutex.Unlock()
-	
-	// If timeout isn't 0, initate the timeout function concurrently
-	timeoutChan := make(chan bool, 1)
-	if timeout > 0 {
-		go func(){
-			// Timeout function
-			time.Sleep(time.Duration(timeout) * time.Second)
-			timeoutChan <- true
-		}()
+
+	if node.ReliableUDP {
+		return node.sendReliableQuery(ctx, codec, procedure, call, messageData, addr, responseChan, reply)
 	}
-	
+
+	buf_bigEndian, err := encodeIntoBigEndian(bytes.NewBuffer(messageData))
+	if err != nil {
+		return err
+	}
+
+	// Send to host, fragmenting if the message doesn't fit in a single datagram
+	if err := node.sendFramed(call.MessageID, buf_bigEndian, addr); err != nil {
+		return err
+	}
+
 	// Wait for response on channel
 	select {
-    case replydata := <-responseChan:
-		// We received a reply
-		// Decode args
-		argsReader := bytes.NewReader(replydata)
-		argsDecoder := bencode.NewDecoder(argsReader)
-		err := argsDecoder.Decode(reply)
-		if err != nil {
+    case result := <-responseChan:
+		// We received a reply. If the handler itself returned an error, surface it as a
+		// RemoteError instead of trying to decode ReturnData.
+		if remoteErr := remoteErrorFor(procedure, result); remoteErr != nil {
+			return remoteErr
+		}
+		if err := codec.Decode(result.ReturnData, reply); err != nil {
 			fmt.Printf("Error decoding reply return data into value: %s\n", err)
 			return err
 		}
-    case <-timeoutChan:
-    	// We timed out
-		return new(TimeoutError)
+    case <-ctx.Done():
+    	// Caller's context expired or was canceled before a reply arrived
+		return ctxErr(ctx)
     }
-    
+
 	return nil
 }
 
+// sendReliableQuery sends a query framed for the reliability layer (Node.ReliableUDP),
+// retransmitting it on an exponential backoff until the peer acks it, the reply arrives, or
+// ctx is done. Once acked, it stops retransmitting and just waits out the reply (or ctx).
+func (node *Node) sendReliableQuery(ctx context.Context, codec Codec, procedure string, thisCall call, messageData []byte, addr net.Addr, responseChan responseChannel, reply interface{}) error {
+	frame := frameReliable(msgQuery, thisCall.MessageID, messageData)
+
+	ackChan := make(chan struct{}, 1)
+	node.acksMutex.Lock()
+	node.acks[thisCall] = ackChan
+	node.acksMutex.Unlock()
+	defer func() {
+		node.acksMutex.Lock()
+		delete(node.acks, thisCall)
+		node.acksMutex.Unlock()
+	}()
+
+	// One initial send plus up to ackMaxRetries retransmits
+	delay := ackRetryBase
+	for attempt := 0; attempt <= ackMaxRetries; attempt++ {
+		if err := node.sendFramed(thisCall.MessageID, frame, addr); err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ackChan:
+			timer.Stop()
+			return node.awaitReply(ctx, codec, procedure, responseChan, reply)
+		case result := <-responseChan:
+			timer.Stop()
+			if remoteErr := remoteErrorFor(procedure, result); remoteErr != nil {
+				return remoteErr
+			}
+			return codec.Decode(result.ReturnData, reply)
+		case <-ctx.Done():
+			timer.Stop()
+			return ctxErr(ctx)
+		case <-timer.C:
+			delay *= 2
+		}
+	}
+
+	return &MaxRetriesExceededError{Retries: ackMaxRetries}
+}
+
+// awaitReply waits for the reply (or ctx's deadline) once a reliable query has been acked,
+// without retransmitting further.
+func (node *Node) awaitReply(ctx context.Context, codec Codec, procedure string, responseChan responseChannel, reply interface{}) error {
+	select {
+	case result := <-responseChan:
+		if remoteErr := remoteErrorFor(procedure, result); remoteErr != nil {
+			return remoteErr
+		}
+		return codec.Decode(result.ReturnData, reply)
+	case <-ctx.Done():
+		return ctxErr(ctx)
+	}
+}
+
+// CallTimeout is a thin wrapper around Call for callers not yet using context.Context;
+// timeout is a maximum time to wait for a reply, in seconds. If timeout is 0, we wait forever.
+func (node *Node) CallTimeout(procedure string, addr net.Addr, args interface{}, reply interface{}, timeout int) (err error) {
+	ctx, cancel := contextFromTimeout(timeout)
+	defer cancel()
+	return node.Call(ctx, procedure, addr, args, reply)
+}
+
 // Registers method as a procedure, which must satisfy the following conditions:
 //	- exported
 //  - has a receiver
-//	- two arguments, both pointers to exported structs
+//	- two arguments, both pointers to exported structs, optionally preceded by a
+//	  context.Context argument
 //	- one return value, of type error
 // It returns an error if the method does not satisfy these conditions
 func (node *Node) Register(receiver interface{}) error {
@@ -366,66 +656,69 @@ func (node *Node) register(receiver interface{}) error {
 		node.procedures = make(map[string]*procedure)
 	}
 	
-	// Declarations
-	argIndex, replyIndex := 1, 2
-	// Method needs two/three ins: receiver, *args, *reply.
-	maxIns := 3
 	receiverType := reflect.TypeOf(receiver)
-	
-	// Install the methods
+
+	// Install the methods, skipping (and logging) any that aren't procedure-shaped instead
+	// of registering them half-checked; a receiver can have other exported methods (e.g. a
+	// String() for debugging) that were never meant to be callable procedures.
 	for m := 0; m < receiverType.NumMethod(); m++ {
 		method := receiverType.Method(m)
-		procedure := new(procedure)
 		methodType := method.Type
 		methodName := method.Name
-		
-		var errorBuf bytes.Buffer
-		throwError := func() error {
-			log.Println(errorBuf.String())
-			return errors.New(errorBuf.String())
+
+		// Declarations: receiver, [context.Context,] *args, *reply.
+		argIndex, replyIndex := 1, 2
+		maxIns := 3
+		hasContext := methodType.NumIn() > 1 && methodType.In(1) == contextType
+		if hasContext {
+			argIndex, replyIndex = 2, 3
+			maxIns = 4
 		}
-		
+
 		if methodType.NumIn() != maxIns {
-			fmt.Fprintln(&errorBuf, "method", methodName, "has wrong number of ins:", methodType.NumIn())
-			throwError()
+			log.Println("qrp: method", methodName, "has wrong number of ins:", methodType.NumIn())
+			continue
 		}
-		
+
 		// First arg need not be a pointer.
 		argType := methodType.In(argIndex)
 		if !isExportedOrBuiltinType(argType) {
-			fmt.Fprintln(&errorBuf, methodName, "argument type not exported:", argType)
-			throwError()
+			log.Println("qrp:", methodName, "argument type not exported:", argType)
+			continue
 		}
-		
+
 		// Second arg must be a pointer.
 		replyType := methodType.In(replyIndex)
 		if replyType.Kind() != reflect.Ptr {
-			fmt.Fprintln(&errorBuf, "method", methodName, "reply type not a pointer:", replyType)
-			throwError()
+			log.Println("qrp: method", methodName, "reply type not a pointer:", replyType)
+			continue
 		}
-		
+
 		// Reply type must be exported.
 		if !isExportedOrBuiltinType(replyType) {
-			fmt.Fprintln(&errorBuf, "method", methodName, "reply type not exported:", replyType)
-			throwError()
+			log.Println("qrp: method", methodName, "reply type not exported:", replyType)
+			continue
 		}
-		
+
 		// Method needs one out.
-		/*if methodType.NumOut() != 1 {
-			fmt.Fprintln(&errorBuf, "method", methodName, "has wrong number of outs:", methodType.NumOut())
-			throwError()
+		if methodType.NumOut() != 1 {
+			log.Println("qrp: method", methodName, "has wrong number of outs:", methodType.NumOut())
+			continue
 		}
-		
+
 		// The return type of the method must be error.
 		if returnType := methodType.Out(0); returnType != typeOfError {
-			fmt.Fprintln(&errorBuf, "method", methodName, "returns", returnType.String(), "not error")
-			throwError()
-		}*/
+			log.Println("qrp: method", methodName, "returns", returnType.String(), "not error")
+			continue
+		}
+
 		// Register method
+		procedure := new(procedure)
 		procedure.Method = method
 		procedure.ArgType = argType
 		procedure.ReplyType = replyType
 		procedure.Receiver = reflect.ValueOf(receiver)
+		procedure.HasContext = hasContext
 		node.procedures[methodName] = procedure
 	}
 	node.proceduresMutex.Unlock()
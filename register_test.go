@@ -0,0 +1,33 @@
+package qrp
+
+import (
+	"testing"
+)
+
+// badHandler has a procedure-shaped method (Good) alongside one with no return value
+// (BadNoError), which used to panic register() via an unchecked methodType.Out(0).
+type badHandler struct{}
+
+func (badHandler) Good(arg *string, reply *string) error {
+	*reply = *arg
+	return nil
+}
+
+func (badHandler) BadNoError(arg *string, reply *string) {
+	*reply = *arg
+}
+
+func TestRegisterSkipsMethodWithNoReturnValue(t *testing.T) {
+	node := newTestNode(t)
+
+	if err := node.Register(badHandler{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if _, ok := node.procedures["Good"]; !ok {
+		t.Error("Register should have registered the procedure-shaped Good method")
+	}
+	if _, ok := node.procedures["BadNoError"]; ok {
+		t.Error("Register should have skipped BadNoError, which has no return value")
+	}
+}
@@ -0,0 +1,76 @@
+package qrp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"time"
+)
+
+// Leading byte on the wire identifying the kind of a reliability-layer frame (see
+// frameReliable), used only when Node.ReliableUDP is enabled.
+type messageType byte
+
+const (
+	msgQuery messageType = iota + 1
+	msgReply
+	msgAck
+	msgNack
+	msgFragment // reserved for fragmentation/reassembly of oversized messages
+	msgCompound // reserved for batching multiple frames into one datagram
+)
+
+const (
+	ackRetryBase  = 200 * time.Millisecond // initial delay before the first retransmit
+	ackMaxRetries = 5                      // retransmit attempts before Call gives up
+)
+
+// How long a (addr, messageID) dedup entry is kept in Node.seenQueries before being
+// reaped, comfortably longer than a query could still be in flight across ackMaxRetries
+// retransmits.
+const seenQueryReapTimeout = 30 * time.Second
+
+// reapStaleSeenQueriesLocked drops dedup entries whose reap timeout has passed, the same
+// way reapStaleFragmentsLocked reaps node.fragments. Must be called with seenMutex held.
+func (node *Node) reapStaleSeenQueriesLocked() {
+	now := time.Now()
+	for key, expires := range node.seenQueries {
+		if now.After(expires) {
+			delete(node.seenQueries, key)
+		}
+	}
+}
+
+// frameReliable wraps data (a codec-encoded Message, or nil for a bare ack/nack) in the
+// reliability layer's header: [type byte][messageID uint32 BE][CRC32(data) uint32 BE][data].
+// The CRC32 lets the receiver drop a corrupted datagram outright instead of handing garbage
+// to the codec.
+func frameReliable(kind messageType, messageID uint32, data []byte) []byte {
+	frame := make([]byte, 9, 9+len(data))
+	frame[0] = byte(kind)
+	binary.BigEndian.PutUint32(frame[1:5], messageID)
+	binary.BigEndian.PutUint32(frame[5:9], crc32.ChecksumIEEE(data))
+	return append(frame, data...)
+}
+
+// parseReliableFrame is the inverse of frameReliable; it returns a CorruptFrameError if raw
+// is too short to contain a header or its checksum doesn't match.
+func parseReliableFrame(raw []byte) (kind messageType, messageID uint32, data []byte, err error) {
+	if len(raw) < 9 {
+		return 0, 0, nil, &CorruptFrameError{}
+	}
+	kind = messageType(raw[0])
+	messageID = binary.BigEndian.Uint32(raw[1:5])
+	checksum := binary.BigEndian.Uint32(raw[5:9])
+	data = raw[9:]
+	if crc32.ChecksumIEEE(data) != checksum {
+		return 0, 0, nil, &CorruptFrameError{}
+	}
+	return kind, messageID, data, nil
+}
+
+// sendAck writes a bare ack/nack frame (no payload) for messageID to addr.
+func (node *Node) sendAck(kind messageType, messageID uint32, addr net.Addr) {
+	frame := frameReliable(kind, messageID, nil)
+	node.sendFramed(messageID, frame, addr)
+}
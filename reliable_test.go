@@ -0,0 +1,139 @@
+package qrp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameReliableRoundTrip(t *testing.T) {
+	data := []byte("hello reliable world")
+	frame := frameReliable(msgQuery, 42, data)
+
+	kind, messageID, payload, err := parseReliableFrame(frame)
+	if err != nil {
+		t.Fatalf("parseReliableFrame returned error: %v", err)
+	}
+	if kind != msgQuery {
+		t.Errorf("kind = %v, want %v", kind, msgQuery)
+	}
+	if messageID != 42 {
+		t.Errorf("messageID = %d, want 42", messageID)
+	}
+	if string(payload) != string(data) {
+		t.Errorf("payload = %q, want %q", payload, data)
+	}
+}
+
+func TestParseReliableFrameDetectsCorruption(t *testing.T) {
+	frame := frameReliable(msgQuery, 1, []byte("payload"))
+	frame[len(frame)-1] ^= 0xFF // flip a bit inside the payload
+
+	if _, _, _, err := parseReliableFrame(frame); err == nil {
+		t.Fatal("expected CorruptFrameError for a tampered frame, got nil")
+	}
+}
+
+func TestParseReliableFrameTooShort(t *testing.T) {
+	if _, _, _, err := parseReliableFrame([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected CorruptFrameError for a too-short frame, got nil")
+	}
+}
+
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	err, node := CreateNode(conn, 1500)
+	if err != nil {
+		t.Fatalf("CreateNode: %v", err)
+	}
+	return node
+}
+
+// TestSeenQueriesReap guards against the dedup map growing without bound: an entry that's
+// past seenQueryReapTimeout must be dropped the next time reapStaleSeenQueriesLocked runs,
+// the same way reapStaleFragmentsLocked reaps node.fragments.
+func TestSeenQueriesReap(t *testing.T) {
+	node := newTestNode(t)
+
+	fresh := call{MessageID: 1, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	stale := call{MessageID: 2, Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}}
+
+	node.seenMutex.Lock()
+	node.seenQueries[fresh] = time.Now().Add(seenQueryReapTimeout)
+	node.seenQueries[stale] = time.Now().Add(-time.Second) // already expired
+	node.reapStaleSeenQueriesLocked()
+	_, freshStillPresent := node.seenQueries[fresh]
+	_, staleStillPresent := node.seenQueries[stale]
+	node.seenMutex.Unlock()
+
+	if !freshStillPresent {
+		t.Error("reapStaleSeenQueriesLocked removed a non-expired entry")
+	}
+	if staleStillPresent {
+		t.Error("reapStaleSeenQueriesLocked left an expired entry in place")
+	}
+}
+
+// echoHandler is a minimal registered procedure used to observe how many times
+// processReliablePacket actually invokes a handler.
+type echoHandler struct {
+	calls int
+}
+
+func (h *echoHandler) Echo(arg *string, reply *string) error {
+	h.calls++
+	*reply = *arg
+	return nil
+}
+
+// TestProcessReliablePacketDedupsRetransmittedQuery drives processReliablePacket with the
+// same msgQuery frame twice, as a retransmit would deliver it before the first ack arrives,
+// and checks the handler only runs once.
+func TestProcessReliablePacketDedupsRetransmittedQuery(t *testing.T) {
+	node := newTestNode(t)
+	node.ReliableUDP = true
+
+	handler := &echoHandler{}
+	if err := node.Register(handler); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	arg := "hi"
+	query := Query{MessageID: 7, ProcedureName: "Echo"}
+	var err error
+	query.ProcedureData, err = node.codec.Encode(&arg)
+	if err != nil {
+		t.Fatalf("encoding query args: %v", err)
+	}
+	messageData, err := envelopeCodec.Encode(Message{Query: &query})
+	if err != nil {
+		t.Fatalf("encoding envelope: %v", err)
+	}
+	frame := frameReliable(msgQuery, query.MessageID, messageData)
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}
+
+	if err := node.processReliablePacket(frame, addr); err != nil {
+		t.Fatalf("first processReliablePacket: %v", err)
+	}
+	if err := node.processReliablePacket(frame, addr); err != nil {
+		t.Fatalf("second (retransmitted) processReliablePacket: %v", err)
+	}
+
+	if handler.calls != 1 {
+		t.Errorf("handler invoked %d times, want 1", handler.calls)
+	}
+
+	node.seenMutex.Lock()
+	entries := len(node.seenQueries)
+	node.seenMutex.Unlock()
+	if entries != 1 {
+		t.Errorf("seenQueries has %d entries after one distinct query, want 1", entries)
+	}
+}
@@ -0,0 +1,56 @@
+package qrp
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Precedes every encoded message on the wire; historically used to detect byte order
+// mismatches between nodes compiled for different architectures.
+var bigEndianMagic = []byte{0x51, 0x52, 0x50, 0x00} // "QRP\x00"
+
+// Strips the big-endian magic prefix added by encodeIntoBigEndian, returning the
+// underlying encoded message
+func decodeIntoBigEndian(buf *bytes.Buffer) ([]byte, error) {
+	data := buf.Bytes()
+	if len(data) < len(bigEndianMagic) || !bytes.Equal(data[:len(bigEndianMagic)], bigEndianMagic) {
+		return nil, &InvalidMessageError{}
+	}
+	return data[len(bigEndianMagic):], nil
+}
+
+// Prefixes buf's contents with the big-endian magic so the receiver can sanity-check
+// the message before handing it to the codec
+func encodeIntoBigEndian(buf *bytes.Buffer) ([]byte, error) {
+	out := make([]byte, 0, len(bigEndianMagic)+buf.Len())
+	out = append(out, bigEndianMagic...)
+	out = append(out, buf.Bytes()...)
+	return out, nil
+}
+
+// Reports whether a type is exported or a builtin, mirroring net/rpc's suitability check
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return isExported(t.Name()) || t.PkgPath() == ""
+}
+
+func isExported(name string) bool {
+	rune, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(rune)
+}
+
+// Builds a context from the legacy 'timeout' seconds convention used by pre-context.Context
+// APIs such as CallTimeout: timeout of 0 means wait forever. The returned cancel func should
+// always be called to release resources, even when timeout is 0.
+func contextFromTimeout(timeout int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+}
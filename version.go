@@ -0,0 +1,146 @@
+package qrp
+
+import (
+	"context"
+	"net"
+)
+
+// Bounds of the protocol versions this build understands. Version negotiates down to
+// the lowest of ProtocolVersionMax and whatever the peer advertises, so older and newer
+// builds of qrp can still talk to each other.
+const (
+	ProtocolVersionMin = 1
+	ProtocolVersionMax = 1
+)
+
+// Sent by the client to open a connection with a peer. The peer responds with the
+// version, codec, and MTU it has chosen from what was offered.
+type VersionQuery struct {
+	MinVersion uint32
+	MaxVersion uint32
+	Codecs     []string // Codec names the client is willing to use, in preference order
+	MTU        uint32   // MTU the client would like to use
+}
+
+type VersionReply struct {
+	Version uint32
+	Codec   string // The codec name chosen from VersionQuery.Codecs
+	MTU     uint32 // min(VersionQuery.MTU, the responder's own MTU)
+}
+
+// The negotiated parameters for a single peer, cached after a successful handshake
+type peerParams struct {
+	Version uint32
+	Codec   Codec
+	MTU     uint32
+}
+
+var namedCodecs = map[string]Codec{
+	"bencode":  BencodeCodec{},
+	"gob":      GobCodec{},
+	"json":     JSONCodec{},
+	"protobuf": ProtobufCodec{},
+}
+
+// codecPreference lists the names in namedCodecs in the order Version should offer them,
+// since ranging over namedCodecs directly would emit them in Go's randomized map order
+// (a different, effectively random choice on every process run).
+var codecPreference = []string{"bencode", "gob", "json", "protobuf"}
+
+// The name versionHandler.Version is registered under by Node.Register's reflection-based
+// naming (method name == procedure name)
+const versionProcedure = "Version"
+
+// versionHandler answers VersionQuery on behalf of a Node; installed automatically by
+// NewNode so every node can respond to a handshake without opting in.
+type versionHandler struct {
+	node *Node
+}
+
+func (h *versionHandler) Version(query *VersionQuery, reply *VersionReply) error {
+	version := query.MaxVersion
+	if version > ProtocolVersionMax {
+		version = ProtocolVersionMax
+	}
+	if version < ProtocolVersionMin {
+		return &UnsupportedVersionError{Requested: query.MaxVersion}
+	}
+
+	codecName := "bencode"
+	for _, name := range query.Codecs {
+		if _, ok := namedCodecs[name]; ok {
+			codecName = name
+			break
+		}
+	}
+
+	mtu := query.MTU
+	if h.node.connectionMTU < mtu {
+		mtu = h.node.connectionMTU
+	}
+
+	reply.Version = version
+	reply.Codec = codecName
+	reply.MTU = mtu
+	return nil
+}
+
+// Version performs the handshake with addr if it hasn't already succeeded, caching the
+// negotiated version/codec/MTU for subsequent Calls to addr. Call invokes this
+// automatically, passing its own ctx through so a caller's deadline/cancellation is
+// honored even on first contact; it's exported so callers can negotiate eagerly and
+// surface failures before issuing application queries.
+func (node *Node) Version(ctx context.Context, addr net.Addr) error {
+	key := addr.String()
+
+	node.peersMutex.Lock()
+	if _, ok := node.peers[key]; ok {
+		node.peersMutex.Unlock()
+		return nil
+	}
+	node.peersMutex.Unlock()
+
+	// Offer our own codec first, so a peer that knows it too settles on it rather than on
+	// whichever named codec leads codecPreference
+	codecNames := make([]string, 0, len(codecPreference))
+	for _, name := range codecPreference {
+		if namedCodecs[name] == node.codec {
+			codecNames = append([]string{name}, codecNames...)
+		} else {
+			codecNames = append(codecNames, name)
+		}
+	}
+
+	query := VersionQuery {
+		MinVersion: ProtocolVersionMin,
+		MaxVersion: ProtocolVersionMax,
+		Codecs: codecNames,
+		MTU: node.connectionMTU,
+	}
+	var reply VersionReply
+	if err := node.Call(ctx, versionProcedure, addr, &query, &reply); err != nil {
+		return err
+	}
+
+	codec, ok := namedCodecs[reply.Codec]
+	if !ok {
+		return &UnsupportedCodecError{Name: reply.Codec}
+	}
+
+	node.peersMutex.Lock()
+	node.peers[key] = &peerParams{Version: reply.Version, Codec: codec, MTU: reply.MTU}
+	node.peersMutex.Unlock()
+
+	return nil
+}
+
+// Returns the negotiated codec for addr, falling back to the node's default codec if
+// no handshake has happened yet
+func (node *Node) codecFor(addr net.Addr) Codec {
+	node.peersMutex.Lock()
+	defer node.peersMutex.Unlock()
+	if params, ok := node.peers[addr.String()]; ok {
+		return params.Codec
+	}
+	return node.codec
+}